@@ -0,0 +1,122 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command gonscovmerge merges two or more Go coverage profile data files,
+// such as the ones produced by re-execution fan-out in integration test
+// suites, into a single profile written to stdout.
+//
+//	gonscovmerge profile1.out profile2.out ... > merged.out
+//
+// By default, blocks are merged the classic go-cover way: execution counts
+// are summed (or OR-ed together, under "set" mode). Passing -policy selects
+// a different way of collapsing the per-process data contributed by each
+// input file, and -sidecar additionally writes an extended JSON sidecar file
+// recording, per block, how many of the input files executed it at all --
+// the primary diagnostic for spotting code that's only ever reached from
+// inside a re-exec'd child.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/thediveo/gons/covmerge"
+)
+
+// policies maps the -policy flag's accepted values to their covmerge.MergePolicy.
+var policies = map[string]covmerge.MergePolicy{
+	"sum":             covmerge.PolicySum,
+	"setunion":        covmerge.PolicySetUnion,
+	"maxperprocess":   covmerge.PolicyMaxPerProcess,
+	"processhitcount": covmerge.PolicyProcessHitCount,
+}
+
+func main() {
+	policyFlag := flag.String("policy", "sum",
+		"how to collapse per-process block data: sum, setunion, maxperprocess, or processhitcount")
+	sidecarFlag := flag.String("sidecar", "",
+		"if set, additionally write an extended per-process JSON sidecar to this path")
+	flag.Parse()
+
+	paths := flag.Args()
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: gonscovmerge [-policy=...] [-sidecar=path] profile.out [profile.out ...]")
+		os.Exit(2)
+	}
+	policy, ok := policies[*policyFlag]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "gonscovmerge: unknown -policy %q\n", *policyFlag)
+		os.Exit(2)
+	}
+
+	// The streaming merger only ever produces the classic, summed-counts
+	// profile, so we can use its bounded-memory code path as long as no
+	// per-process breakdown was asked for.
+	if policy == covmerge.PolicySum && *sidecarFlag == "" {
+		inputs := make([]io.Reader, 0, len(paths))
+		for _, path := range paths {
+			f, err := os.Open(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "gonscovmerge: %s\n", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			inputs = append(inputs, f)
+		}
+		if err := covmerge.MergeStreaming(os.Stdout, inputs...); err != nil {
+			fmt.Fprintf(os.Stderr, "gonscovmerge: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Any other policy, or a requested sidecar, needs the per-process
+	// statistics a ProcessProfile tracks, so fall back to the in-memory path.
+	pp := covmerge.NewProcessProfile()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gonscovmerge: %s\n", err)
+			os.Exit(1)
+		}
+		cp, err := covmerge.Read(f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gonscovmerge: %s: %s\n", path, err)
+			os.Exit(1)
+		}
+		if err := covmerge.MergeProcessProfile(pp, cp); err != nil {
+			fmt.Fprintf(os.Stderr, "gonscovmerge: %s: %s\n", path, err)
+			os.Exit(1)
+		}
+	}
+	if _, err := pp.Profile(policy).WriteTo(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "gonscovmerge: %s\n", err)
+		os.Exit(1)
+	}
+	if *sidecarFlag != "" {
+		sc, err := os.Create(*sidecarFlag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "gonscovmerge: %s\n", err)
+			os.Exit(1)
+		}
+		defer sc.Close()
+		if err := pp.WriteSidecarJSON(sc); err != nil {
+			fmt.Fprintf(os.Stderr, "gonscovmerge: %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
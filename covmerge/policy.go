@@ -0,0 +1,228 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package covmerge
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MergePolicy selects how a ProcessProfile's per-block, per-process
+// statistics are collapsed back down into a single execution count when
+// rendering a classic Profile.
+type MergePolicy int
+
+const (
+	// PolicySum reproduces the classic go-cover merge behaviour: the
+	// execution counts contributed by every profile are simply added up (or,
+	// under "set" mode, OR-ed together).
+	PolicySum MergePolicy = iota
+	// PolicySetUnion collapses a block's data down to whether *any*
+	// contributing profile executed it at all, regardless of how many times
+	// or under which coverage mode it was recorded.
+	PolicySetUnion
+	// PolicyMaxPerProcess keeps the highest single-profile execution count
+	// recorded for a block, instead of summing across profiles.
+	PolicyMaxPerProcess
+	// PolicyProcessHitCount reports how many distinct profiles executed a
+	// block at all, instead of how many times it was executed in total. This
+	// is the primary diagnostic for spotting code that is only ever reached
+	// from inside a re-exec'd child.
+	PolicyProcessHitCount
+)
+
+// ProcessBlock extends a Block with cross-process statistics: how many
+// distinct profiles contributed any execution of this block (Processes), the
+// combined execution count across all of them (Total), and the highest
+// execution count contributed by any single profile (Max). The embedded
+// Block's own Count field is left at zero; use Total, Max or Processes
+// instead, depending on what question is being asked.
+type ProcessBlock struct {
+	Block
+	Processes int
+	Total     int
+	Max       int
+}
+
+// ProcessSource holds the per-process coverage statistics for a single
+// source file, as accumulated by MergeProcessProfile.
+type ProcessSource struct {
+	FileName string
+	Blocks   []ProcessBlock
+
+	index map[blockPos]int // position -> index into Blocks, for O(1) lookup while merging.
+}
+
+// blockPos identifies a code block by its source position alone, ignoring
+// its statement count and execution count.
+type blockPos struct {
+	StartLine, StartCol, EndLine, EndCol int
+}
+
+// ProcessProfile is a coverage profile that, instead of collapsing every
+// contributing profile's execution counts into one number right away, keeps
+// track of per-block, per-process statistics. A ProcessProfile is rendered
+// back down into a classic Profile -- or into an extended JSON sidecar file
+// -- only once all profiles have been merged in, via Profile and
+// WriteSidecarJSON respectively.
+type ProcessProfile struct {
+	// Mode of coverage profile: "atomic", "count", or "set".
+	Mode string
+	// Sources with per-process block coverage data, indexed by source file
+	// name.
+	Sources map[string]*ProcessSource
+}
+
+// NewProcessProfile returns a new and correctly initialized ProcessProfile.
+func NewProcessProfile() *ProcessProfile {
+	return &ProcessProfile{Sources: map[string]*ProcessSource{}}
+}
+
+// MergeProcessProfile folds the coverage data from src into dst, treating
+// src as having been contributed by a single process. Unlike Profile.Merge,
+// which only ever needs to know the combined execution count, this also
+// updates, for every block touched by src, how many distinct processes have
+// now contributed to it and what the highest single-process count was.
+func MergeProcessProfile(dst *ProcessProfile, src *Profile) error {
+	if src == nil {
+		return nil
+	}
+	if dst.Mode == "" {
+		dst.Mode = src.Mode
+	} else if src.Mode != "" && src.Mode != dst.Mode {
+		return fmt.Errorf(
+			"covmerge: mode mismatch: expected %q, got %q", dst.Mode, src.Mode)
+	}
+	for srcname, source := range src.Sources {
+		dstsource, ok := dst.Sources[srcname]
+		if !ok {
+			dstsource = &ProcessSource{FileName: srcname}
+			dst.Sources[srcname] = dstsource
+		}
+		for _, b := range source.Blocks {
+			dstsource.add(b)
+		}
+	}
+	return nil
+}
+
+// add folds a single contributing Block into this source's per-process
+// statistics, creating a new ProcessBlock the first time this code location
+// is seen.
+func (s *ProcessSource) add(b Block) {
+	if s.index == nil {
+		s.index = map[blockPos]int{}
+	}
+	pos := blockPos{b.StartLine, b.StartCol, b.EndLine, b.EndCol}
+	idx, ok := s.index[pos]
+	if !ok {
+		idx = len(s.Blocks)
+		pb := ProcessBlock{Block: b}
+		pb.Block.Count = 0
+		s.Blocks = append(s.Blocks, pb)
+		s.index[pos] = idx
+	}
+	pbl := &s.Blocks[idx]
+	if b.Count > 0 {
+		pbl.Processes++
+	}
+	pbl.Total += b.Count
+	if b.Count > pbl.Max {
+		pbl.Max = b.Count
+	}
+}
+
+// Profile collapses pp back down into a classic Profile, applying policy to
+// decide each block's resulting Count.
+func (pp *ProcessProfile) Profile(policy MergePolicy) *Profile {
+	p := New()
+	p.Mode = pp.Mode
+	for srcname, source := range pp.Sources {
+		out := &Source{FileName: srcname}
+		for _, pb := range source.Blocks {
+			count := 0
+			switch policy {
+			case PolicySum:
+				count = pb.Total
+				if pp.Mode == "set" && count > 0 {
+					count = 1
+				}
+			case PolicySetUnion:
+				if pb.Processes > 0 {
+					count = 1
+				}
+			case PolicyMaxPerProcess:
+				count = pb.Max
+			case PolicyProcessHitCount:
+				count = pb.Processes
+			}
+			block := pb.Block
+			block.Count = count
+			out.Blocks = append(out.Blocks, block)
+		}
+		sort.Sort(blocksByStart(out.Blocks))
+		p.Sources[srcname] = out
+	}
+	return p
+}
+
+// sidecarRecord is one line of the extended JSON sidecar format emitted by
+// WriteSidecarJSON, giving downstream tools access to the per-process
+// statistics a classic coverage profile cannot represent.
+type sidecarRecord struct {
+	File      string `json:"file"`
+	Block     string `json:"block"`
+	Processes int    `json:"processes"`
+	Total     int    `json:"total"`
+}
+
+// WriteSidecarJSON writes one JSON object per code block to w, each giving
+// the block's source file, its position, how many distinct processes
+// executed it, and the combined execution count across all of them. This is
+// meant to be used alongside -- not instead of -- a classic coverage profile
+// produced via Profile, for tools that want to ask "which blocks are only
+// ever executed inside a re-exec'd child?".
+func (pp *ProcessProfile) WriteSidecarJSON(w io.Writer) error {
+	srcnames := make([]string, 0, len(pp.Sources))
+	for srcname := range pp.Sources {
+		srcnames = append(srcnames, srcname)
+	}
+	sort.Strings(srcnames)
+	enc := json.NewEncoder(w)
+	for _, srcname := range srcnames {
+		source := pp.Sources[srcname]
+		blocks := append([]ProcessBlock(nil), source.Blocks...)
+		sort.Slice(blocks, func(i, j int) bool {
+			bi, bj := blocks[i].Block, blocks[j].Block
+			return bi.StartLine < bj.StartLine ||
+				(bi.StartLine == bj.StartLine && bi.StartCol < bj.StartCol)
+		})
+		for _, pb := range blocks {
+			rec := sidecarRecord{
+				File: srcname,
+				Block: fmt.Sprintf("%d.%d,%d.%d",
+					pb.StartLine, pb.StartCol, pb.EndLine, pb.EndCol),
+				Processes: pb.Processes,
+				Total:     pb.Total,
+			}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
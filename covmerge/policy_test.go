@@ -0,0 +1,116 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package covmerge
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func mustMergeProcessProfiles(t *testing.T, inputs ...string) *ProcessProfile {
+	t.Helper()
+	pp := NewProcessProfile()
+	for _, in := range inputs {
+		cp, err := Read(strings.NewReader(in))
+		if err != nil {
+			t.Fatalf("Read: unexpected error: %s", err)
+		}
+		if err := MergeProcessProfile(pp, cp); err != nil {
+			t.Fatalf("MergeProcessProfile: unexpected error: %s", err)
+		}
+	}
+	return pp
+}
+
+func TestMergeProcessProfilePolicies(t *testing.T) {
+	// Block a.go:1.1,2.2 is listed by all three processes (5, 0, 3), but only
+	// executed by the first and third; block a.go:3.1,4.2 only by the second
+	// one.
+	pp := mustMergeProcessProfiles(t,
+		"mode: count\na.go:1.1,2.2 1 5\n",
+		"mode: count\na.go:1.1,2.2 1 0\na.go:3.1,4.2 1 9\n",
+		"mode: count\na.go:1.1,2.2 1 3\n",
+	)
+
+	cases := []struct {
+		policy MergePolicy
+		first  int // expected Count for a.go:1.1,2.2
+		second int // expected Count for a.go:3.1,4.2
+	}{
+		{PolicySum, 8, 9},
+		{PolicySetUnion, 1, 1},
+		{PolicyMaxPerProcess, 5, 9},
+		{PolicyProcessHitCount, 2, 1},
+	}
+	for _, c := range cases {
+		p := pp.Profile(c.policy)
+		blocks := p.Sources["a.go"].Blocks
+		if len(blocks) != 2 {
+			t.Fatalf("policy %d: len(Blocks) = %d, want 2", c.policy, len(blocks))
+		}
+		if got := blocks[0].Count; got != c.first {
+			t.Errorf("policy %d: first block Count = %d, want %d", c.policy, got, c.first)
+		}
+		if got := blocks[1].Count; got != c.second {
+			t.Errorf("policy %d: second block Count = %d, want %d", c.policy, got, c.second)
+		}
+	}
+}
+
+func TestMergeProcessProfileModeMismatchErrors(t *testing.T) {
+	pp := NewProcessProfile()
+	cp1, _ := Read(strings.NewReader("mode: count\na.go:1.1,2.2 1 1\n"))
+	if err := MergeProcessProfile(pp, cp1); err != nil {
+		t.Fatalf("MergeProcessProfile: unexpected error: %s", err)
+	}
+	cp2, _ := Read(strings.NewReader("mode: atomic\na.go:1.1,2.2 1 1\n"))
+	if err := MergeProcessProfile(pp, cp2); err == nil {
+		t.Fatal("MergeProcessProfile: expected a mode-mismatch error, got nil")
+	}
+}
+
+func TestWriteSidecarJSONShape(t *testing.T) {
+	pp := mustMergeProcessProfiles(t,
+		"mode: count\na.go:1.1,2.2 1 5\n",
+		"mode: count\na.go:1.1,2.2 1 3\n",
+	)
+	var out bytes.Buffer
+	if err := pp.WriteSidecarJSON(&out); err != nil {
+		t.Fatalf("WriteSidecarJSON: unexpected error: %s", err)
+	}
+	var rec struct {
+		File      string `json:"file"`
+		Block     string `json:"block"`
+		Processes int    `json:"processes"`
+		Total     int    `json:"total"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(out.Bytes()), &rec); err != nil {
+		t.Fatalf("unmarshal sidecar record: unexpected error: %s (output was %q)", err, out.String())
+	}
+	if rec.File != "a.go" {
+		t.Errorf("File = %q, want %q", rec.File, "a.go")
+	}
+	if rec.Block != "1.1,2.2" {
+		t.Errorf("Block = %q, want %q", rec.Block, "1.1,2.2")
+	}
+	if rec.Processes != 2 {
+		t.Errorf("Processes = %d, want 2", rec.Processes)
+	}
+	if rec.Total != 8 {
+		t.Errorf("Total = %d, want 8", rec.Total)
+	}
+}
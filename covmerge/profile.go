@@ -0,0 +1,247 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package covmerge reads, merges, and writes Go coverage profile data, in
+// the same text format as produced by "go test -coverprofile" and understood
+// by "golang.org/x/tools/cover". It exists so that users re-executing their
+// own binaries -- for instance, to switch Linux-kernel namespaces the way
+// gons does -- can merge the resulting per-process coverage profiles back
+// into a single one, without having to pull in gons itself or a separate
+// third-party tool.
+package covmerge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Block represents a single block of coverage profile data, identified by
+// its start and end position in the source file, together with the number
+// of statements and the execution count recorded for it.
+type Block struct {
+	StartLine int // line number for block start.
+	StartCol  int // column number for block start.
+	EndLine   int // line number for block end.
+	EndCol    int // column number for block end.
+	NumStmt   int // number of statements included in this block.
+	Count     int // number of times this block was executed.
+}
+
+// Source holds the coverage Blocks recorded for a single source file.
+type Source struct {
+	FileName string  // name of the source file, as recorded in the profile.
+	Blocks   []Block // coverage blocks for this source file.
+}
+
+// Profile represents a Go coverage profile, either as read from a single
+// coverage profile data file, or as the result of merging several of them.
+type Profile struct {
+	// Mode of coverage profile: "atomic", "count", or "set".
+	Mode string
+	// Sources with block coverage data, indexed by source file name.
+	Sources map[string]*Source
+}
+
+// New returns a new, empty Profile, ready to be merged into or written out.
+func New() *Profile {
+	return &Profile{
+		Sources: map[string]*Source{},
+	}
+}
+
+// modeRe specifies the format of the first "mode:" text line of a coverage
+// profile data file.
+var modeRe = regexp.MustCompile(`^mode: ([[:alpha:]]+)$`)
+
+// blockRe specifies the format of the block text lines in coverage profile
+// data files.
+var blockRe = regexp.MustCompile(
+	`^(.+):([0-9]+)\.([0-9]+),([0-9]+)\.([0-9]+) ([0-9]+) ([0-9]+)$`)
+
+// Read parses the coverage profile data available from r and returns it as a
+// Profile. Read returns an error instead of panicking if r's contents don't
+// match the expected coverage profile text format.
+func Read(r io.Reader) (*Profile, error) {
+	p := New()
+	scan := bufio.NewScanner(r)
+	if !scan.Scan() {
+		if err := scan.Err(); err != nil {
+			return nil, fmt.Errorf("covmerge: %w", err)
+		}
+		return p, nil
+	}
+	line := scan.Text()
+	m := modeRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf(
+			"covmerge: line %q doesn't match expected mode: line format", line)
+	}
+	p.Mode = m[1]
+	var srcname string
+	var source *Source
+	for scan.Scan() {
+		line := scan.Text()
+		m := blockRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf(
+				"covmerge: line %q doesn't match expected block line format", line)
+		}
+		if m[1] != srcname {
+			srcname = m[1]
+			source = &Source{FileName: srcname}
+			p.Sources[srcname] = source
+		}
+		block, err := parseBlock(m)
+		if err != nil {
+			return nil, fmt.Errorf("covmerge: line %q: %w", line, err)
+		}
+		source.Blocks = append(source.Blocks, block)
+	}
+	if err := scan.Err(); err != nil {
+		return nil, fmt.Errorf("covmerge: %w", err)
+	}
+	return p, nil
+}
+
+// parseBlock turns an already blockRe-matched submatch slice into a Block.
+// Even though blockRe has already validated that each field consists of
+// decimal digits, the values themselves may still overflow int, so
+// parseBlock returns an error rather than silently truncating them to 0.
+func parseBlock(m []string) (Block, error) {
+	startLine, err := atoi(m[2])
+	if err != nil {
+		return Block{}, err
+	}
+	startCol, err := atoi(m[3])
+	if err != nil {
+		return Block{}, err
+	}
+	endLine, err := atoi(m[4])
+	if err != nil {
+		return Block{}, err
+	}
+	endCol, err := atoi(m[5])
+	if err != nil {
+		return Block{}, err
+	}
+	numStmt, err := atoi(m[6])
+	if err != nil {
+		return Block{}, err
+	}
+	count, err := atoi(m[7])
+	if err != nil {
+		return Block{}, err
+	}
+	return Block{
+		StartLine: startLine,
+		StartCol:  startCol,
+		EndLine:   endLine,
+		EndCol:    endCol,
+		NumStmt:   numStmt,
+		Count:     count,
+	}, nil
+}
+
+// atoi converts a textual integer value into an int, returning an error
+// instead of silently truncating it to 0 if the value doesn't fit.
+func atoi(s string) (int, error) {
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q: %w", s, err)
+	}
+	return v, nil
+}
+
+// Merge merges the coverage profile data from other into p. If p is still
+// empty, p simply adopts other's Mode; otherwise Merge returns an error
+// instead of panicking if other was recorded with a different Mode, since
+// blocks recorded under different coverage modes cannot be combined
+// meaningfully.
+func (p *Profile) Merge(other *Profile) error {
+	if other == nil {
+		return nil
+	}
+	if p.Mode == "" {
+		p.Mode = other.Mode
+	} else if other.Mode != "" && other.Mode != p.Mode {
+		return fmt.Errorf(
+			"covmerge: mode mismatch: expected %q, got %q", p.Mode, other.Mode)
+	}
+	setmode := p.Mode == "set"
+	for srcname, source := range other.Sources {
+		sumsource, ok := p.Sources[srcname]
+		if !ok {
+			sumsource = &Source{FileName: srcname, Blocks: source.Blocks}
+			p.Sources[srcname] = sumsource
+		} else {
+			sumsource.Blocks = append(sumsource.Blocks, source.Blocks...)
+		}
+		mergeBlocks(sumsource, setmode)
+	}
+	return nil
+}
+
+// blocksByStart is a type alias for sorting slices of Blocks by their
+// starting position.
+type blocksByStart []Block
+
+func (b blocksByStart) Len() int      { return len(b) }
+func (b blocksByStart) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b blocksByStart) Less(i, j int) bool {
+	bi, bj := b[i], b[j]
+	return bi.StartLine < bj.StartLine ||
+		(bi.StartLine == bj.StartLine && bi.StartCol < bj.StartCol)
+}
+
+// mergeBlocks merges coverage blocks that refer to the same code location in
+// sumsource, so that only one block per unique code location remains.
+func mergeBlocks(sumsource *Source, setmode bool) {
+	// First sort, so that multiple coverages for the same block location will
+	// be adjacent.
+	sort.Sort(blocksByStart(sumsource.Blocks))
+	mergeidx := 0
+	for idx := mergeidx + 1; idx < len(sumsource.Blocks); idx++ {
+		mergeblock := &sumsource.Blocks[mergeidx]
+		block := &sumsource.Blocks[idx]
+		if mergeblock.StartLine == block.StartLine &&
+			mergeblock.StartCol == block.StartCol &&
+			mergeblock.EndLine == block.EndLine &&
+			mergeblock.EndCol == block.EndCol {
+			// We've found a(nother) matching code block, so update the
+			// first's coverage data.
+			if setmode {
+				if block.Count != 0 {
+					mergeblock.Count = 1
+				}
+			} else {
+				mergeblock.Count += block.Count
+			}
+			continue
+		}
+		// We've reached a different code location after a set of mergeable
+		// locations, so move this new location block downwards to the end of
+		// already merged blocks.
+		mergeidx++
+		if mergeidx != idx {
+			sumsource.Blocks[mergeidx] = *block
+		}
+	}
+	// Shorten the code block locations slice to only, erm, "cover" the unique
+	// (and probably merged) blocks.
+	sumsource.Blocks = sumsource.Blocks[:mergeidx+1]
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package covmerge
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadAndWriteTo(t *testing.T) {
+	const in = `mode: count
+a.go:1.1,2.2 3 1
+a.go:5.1,6.2 2 4
+b.go:1.1,2.2 1 2
+`
+	p, err := Read(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Read: unexpected error: %s", err)
+	}
+	if p.Mode != "count" {
+		t.Errorf("Mode = %q, want %q", p.Mode, "count")
+	}
+	if len(p.Sources) != 2 {
+		t.Fatalf("len(Sources) = %d, want 2", len(p.Sources))
+	}
+	var out bytes.Buffer
+	if _, err := p.WriteTo(&out); err != nil {
+		t.Fatalf("WriteTo: unexpected error: %s", err)
+	}
+	if out.String() != in {
+		t.Errorf("WriteTo round-trip mismatch:\ngot:\n%s\nwant:\n%s", out.String(), in)
+	}
+}
+
+func TestReadInvalidModeLine(t *testing.T) {
+	_, err := Read(strings.NewReader("not a mode line\n"))
+	if err == nil {
+		t.Fatal("Read: expected an error for an invalid mode line, got nil")
+	}
+}
+
+func TestReadInvalidBlockLine(t *testing.T) {
+	_, err := Read(strings.NewReader("mode: count\nnot a block line\n"))
+	if err == nil {
+		t.Fatal("Read: expected an error for an invalid block line, got nil")
+	}
+}
+
+func TestReadBlockCountOverflow(t *testing.T) {
+	_, err := Read(strings.NewReader(
+		"mode: count\na.go:1.1,2.2 1 99999999999999999999\n"))
+	if err == nil {
+		t.Fatal("Read: expected an error for an out-of-range count, got nil")
+	}
+}
+
+func TestMergeSumsCounts(t *testing.T) {
+	a, err := Read(strings.NewReader("mode: count\na.go:1.1,2.2 3 1\n"))
+	if err != nil {
+		t.Fatalf("Read a: unexpected error: %s", err)
+	}
+	b, err := Read(strings.NewReader("mode: count\na.go:1.1,2.2 3 2\n"))
+	if err != nil {
+		t.Fatalf("Read b: unexpected error: %s", err)
+	}
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge: unexpected error: %s", err)
+	}
+	got := a.Sources["a.go"].Blocks[0].Count
+	if got != 3 {
+		t.Errorf("merged Count = %d, want 3", got)
+	}
+}
+
+func TestMergeSetModeUnions(t *testing.T) {
+	a, _ := Read(strings.NewReader("mode: set\na.go:1.1,2.2 3 0\n"))
+	b, _ := Read(strings.NewReader("mode: set\na.go:1.1,2.2 3 1\n"))
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge: unexpected error: %s", err)
+	}
+	got := a.Sources["a.go"].Blocks[0].Count
+	if got != 1 {
+		t.Errorf("merged Count = %d, want 1", got)
+	}
+}
+
+func TestMergeModeMismatchErrors(t *testing.T) {
+	a, _ := Read(strings.NewReader("mode: count\na.go:1.1,2.2 3 1\n"))
+	b, _ := Read(strings.NewReader("mode: atomic\na.go:1.1,2.2 3 1\n"))
+	if err := a.Merge(b); err == nil {
+		t.Fatal("Merge: expected a mode-mismatch error, got nil")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package covmerge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// MergeStreaming merges the coverage profile data read from inputs and
+// writes the merged result to out, in the standard Go coverage profile text
+// format. Unlike Read/Merge/WriteTo, which load every block of every input
+// into memory and then re-sort the whole, ever-growing per-source block list
+// on every single merge, MergeStreaming processes one input at a time and
+// never holds more than one contiguous per-source-file run of blocks from
+// the *current* input in memory. Each run is merged into the accumulated
+// result for its source file with a single linear merge-join of two already
+// sorted slices, instead of appending and re-sorting from scratch, which is
+// what made the naive approach quadratic in the first place.
+//
+// MergeStreaming relies on the same invariant readcovfile already exploited:
+// Go's coverage writer emits all blocks for one source file contiguously
+// (even though the blocks themselves aren't sorted). It does NOT require
+// inputs to agree on the relative order in which they enumerate source
+// files -- each input's runs are folded into the result by source file name,
+// looked up in a map, so two inputs may list "a.go" and "b.go" in opposite
+// order (as happens whenever they come from different binaries or
+// packages) and still merge correctly.
+func MergeStreaming(out io.Writer, inputs ...io.Reader) error {
+	if len(inputs) == 0 {
+		return nil
+	}
+	sum := New()
+	for _, r := range inputs {
+		it, mode, err := newRunIterator(r)
+		if err != nil {
+			return err
+		}
+		if mode != "" {
+			if sum.Mode == "" {
+				sum.Mode = mode
+			} else if mode != sum.Mode {
+				return fmt.Errorf(
+					"covmerge: mode mismatch: expected %q, got %q", sum.Mode, mode)
+			}
+		}
+		for !it.atEOF {
+			setmode := sum.Mode == "set"
+			if existing, ok := sum.Sources[it.srcname]; ok {
+				existing.Blocks = mergeSortedBlocks(existing.Blocks, it.blocks, setmode)
+			} else {
+				sum.Sources[it.srcname] = &Source{
+					FileName: it.srcname,
+					Blocks:   append([]Block(nil), it.blocks...),
+				}
+			}
+			if err := it.loadNextRun(); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := sum.WriteTo(out)
+	return err
+}
+
+// MergeFiles is a small convenience wrapper around Read, Merge and WriteTo
+// for callers merging only a handful of small coverage profiles, where the
+// extra memory and GC overhead of loading every input at once doesn't
+// matter. Large merges -- such as integration suites fanning out across many
+// re-exec'd children -- should use MergeStreaming instead.
+func MergeFiles(out io.Writer, inputs ...io.Reader) error {
+	sum := New()
+	for _, r := range inputs {
+		cp, err := Read(r)
+		if err != nil {
+			return err
+		}
+		if err := sum.Merge(cp); err != nil {
+			return err
+		}
+	}
+	_, err := sum.WriteTo(out)
+	return err
+}
+
+// mergeSortedBlocks merges existing and incoming, two already
+// position-sorted and duplicate-free slices of Blocks for the same source
+// file, combining the counts of blocks that share the same code location,
+// without re-sorting either slice from scratch.
+func mergeSortedBlocks(existing, incoming []Block, setmode bool) []Block {
+	merged := make([]Block, 0, len(existing)+len(incoming))
+	i, j := 0, 0
+	for i < len(existing) && j < len(incoming) {
+		a, b := existing[i], incoming[j]
+		switch {
+		case blockPosLess(a, b):
+			merged = append(merged, a)
+			i++
+		case blockPosLess(b, a):
+			merged = append(merged, b)
+			j++
+		default:
+			if setmode {
+				if b.Count != 0 {
+					a.Count = 1
+				}
+			} else {
+				a.Count += b.Count
+			}
+			merged = append(merged, a)
+			i++
+			j++
+		}
+	}
+	merged = append(merged, existing[i:]...)
+	merged = append(merged, incoming[j:]...)
+	return merged
+}
+
+// blockPosLess reports whether a's code location sorts before b's.
+func blockPosLess(a, b Block) bool {
+	return a.StartLine < b.StartLine ||
+		(a.StartLine == b.StartLine && a.StartCol < b.StartCol)
+}
+
+// runIterator incrementally reads one input's coverage profile data one
+// contiguous per-source-file run at a time, so that a caller merging several
+// inputs never needs to hold more than one run per input in memory.
+type runIterator struct {
+	scan        *bufio.Scanner
+	pendingLine string // a block line already read from scan, but not yet assigned to a run.
+	atEOF       bool
+	srcname     string
+	blocks      []Block // the current run's blocks, already sorted by position.
+}
+
+// newRunIterator creates a runIterator reading from r, loads its first run,
+// and returns the coverage mode found on r's first line.
+func newRunIterator(r io.Reader) (*runIterator, string, error) {
+	it := &runIterator{scan: bufio.NewScanner(r)}
+	if !it.scan.Scan() {
+		if err := it.scan.Err(); err != nil {
+			return nil, "", err
+		}
+		it.atEOF = true
+		return it, "", nil
+	}
+	m := modeRe.FindStringSubmatch(it.scan.Text())
+	if m == nil {
+		return nil, "", fmt.Errorf(
+			"covmerge: line %q doesn't match expected mode: line format",
+			it.scan.Text())
+	}
+	if err := it.loadNextRun(); err != nil {
+		return nil, "", err
+	}
+	return it, m[1], nil
+}
+
+// loadNextRun reads the next contiguous per-source-file run of blocks from
+// the underlying scanner and sorts it by position, replacing the
+// previously-returned run.
+func (it *runIterator) loadNextRun() error {
+	line := it.pendingLine
+	it.pendingLine = ""
+	if line == "" {
+		if !it.scan.Scan() {
+			if err := it.scan.Err(); err != nil {
+				return err
+			}
+			it.atEOF = true
+			it.srcname, it.blocks = "", nil
+			return nil
+		}
+		line = it.scan.Text()
+	}
+	m := blockRe.FindStringSubmatch(line)
+	if m == nil {
+		return fmt.Errorf(
+			"covmerge: line %q doesn't match expected block line format", line)
+	}
+	srcname := m[1]
+	block, err := parseBlock(m)
+	if err != nil {
+		return fmt.Errorf("covmerge: line %q: %w", line, err)
+	}
+	run := []Block{block}
+	for it.scan.Scan() {
+		line = it.scan.Text()
+		m = blockRe.FindStringSubmatch(line)
+		if m == nil {
+			return fmt.Errorf(
+				"covmerge: line %q doesn't match expected block line format", line)
+		}
+		if m[1] != srcname {
+			it.pendingLine = line
+			break
+		}
+		block, err := parseBlock(m)
+		if err != nil {
+			return fmt.Errorf("covmerge: line %q: %w", line, err)
+		}
+		run = append(run, block)
+	}
+	if err := it.scan.Err(); err != nil {
+		return err
+	}
+	it.srcname = srcname
+	sumsource := &Source{Blocks: run}
+	// mergeBlocks also sorts; "setmode" doesn't matter here since within a
+	// single run there's nothing yet to combine -- we only want the sort.
+	mergeBlocks(sumsource, false)
+	it.blocks = sumsource.Blocks
+	return nil
+}
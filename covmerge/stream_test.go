@@ -0,0 +1,118 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package covmerge
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestMergeStreamingReorderedSourceFiles is a regression test for a bug where
+// MergeStreaming silently produced duplicate, unmerged blocks whenever two
+// inputs enumerated the same source files in a different relative order --
+// exactly what happens when the merged profiles come from different
+// binaries or packages.
+func TestMergeStreamingReorderedSourceFiles(t *testing.T) {
+	const in1 = `mode: count
+b.go:1.1,2.2 1 5
+a.go:1.1,2.2 1 7
+`
+	const in2 = `mode: count
+a.go:1.1,2.2 1 2
+b.go:1.1,2.2 1 3
+`
+	var out bytes.Buffer
+	if err := MergeStreaming(&out, strings.NewReader(in1), strings.NewReader(in2)); err != nil {
+		t.Fatalf("MergeStreaming: unexpected error: %s", err)
+	}
+	p, err := Read(strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatalf("Read merged output: unexpected error: %s", err)
+	}
+	if got := len(p.Sources["a.go"].Blocks); got != 1 {
+		t.Fatalf("len(a.go Blocks) = %d, want 1 (output was:\n%s)", got, out.String())
+	}
+	if got := p.Sources["a.go"].Blocks[0].Count; got != 9 {
+		t.Errorf("a.go Count = %d, want 9", got)
+	}
+	if got := len(p.Sources["b.go"].Blocks); got != 1 {
+		t.Fatalf("len(b.go Blocks) = %d, want 1 (output was:\n%s)", got, out.String())
+	}
+	if got := p.Sources["b.go"].Blocks[0].Count; got != 8 {
+		t.Errorf("b.go Count = %d, want 8", got)
+	}
+}
+
+// TestMergeStreamingMatchesMergeFiles checks that MergeStreaming's
+// bounded-memory merge-join produces exactly the same result as the
+// straightforward Read/Merge/WriteTo path, for both a normal and a
+// file-order-reordered pair of inputs.
+func TestMergeStreamingMatchesMergeFiles(t *testing.T) {
+	cases := []struct {
+		name string
+		in1  string
+		in2  string
+	}{
+		{
+			name: "same file order",
+			in1:  "mode: count\na.go:1.1,2.2 1 7\nb.go:1.1,2.2 1 5\n",
+			in2:  "mode: count\na.go:1.1,2.2 1 2\nb.go:1.1,2.2 1 3\n",
+		},
+		{
+			name: "reordered files",
+			in1:  "mode: count\nb.go:1.1,2.2 1 5\na.go:1.1,2.2 1 7\n",
+			in2:  "mode: count\na.go:1.1,2.2 1 2\nb.go:1.1,2.2 1 3\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var streamed bytes.Buffer
+			if err := MergeStreaming(&streamed,
+				strings.NewReader(c.in1), strings.NewReader(c.in2)); err != nil {
+				t.Fatalf("MergeStreaming: unexpected error: %s", err)
+			}
+			var inmem bytes.Buffer
+			if err := MergeFiles(&inmem,
+				strings.NewReader(c.in1), strings.NewReader(c.in2)); err != nil {
+				t.Fatalf("MergeFiles: unexpected error: %s", err)
+			}
+			if streamed.String() != inmem.String() {
+				t.Errorf("MergeStreaming and MergeFiles disagree:\nstreamed:\n%s\nin-memory:\n%s",
+					streamed.String(), inmem.String())
+			}
+		})
+	}
+}
+
+func TestMergeStreamingModeMismatchErrors(t *testing.T) {
+	var out bytes.Buffer
+	err := MergeStreaming(&out,
+		strings.NewReader("mode: count\na.go:1.1,2.2 1 1\n"),
+		strings.NewReader("mode: atomic\na.go:1.1,2.2 1 1\n"))
+	if err == nil {
+		t.Fatal("MergeStreaming: expected a mode-mismatch error, got nil")
+	}
+}
+
+func TestMergeStreamingNoInputs(t *testing.T) {
+	var out bytes.Buffer
+	if err := MergeStreaming(&out); err != nil {
+		t.Fatalf("MergeStreaming: unexpected error for no inputs: %s", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("MergeStreaming with no inputs wrote %d bytes, want 0", out.Len())
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package covmerge
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// WriteTo writes p out in the standard Go coverage profile text format, as
+// understood by "go tool cover" and "golang.org/x/tools/cover". Source files
+// are written in lexical order, and their blocks in start-position order, so
+// that WriteTo produces a deterministic result regardless of the order in
+// which p was assembled.
+func (p *Profile) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	mode := p.Mode
+	if mode == "" {
+		mode = "set"
+	}
+	n, err := fmt.Fprintf(w, "mode: %s\n", mode)
+	written += int64(n)
+	if err != nil {
+		return written, err
+	}
+	srcnames := make([]string, 0, len(p.Sources))
+	for srcname := range p.Sources {
+		srcnames = append(srcnames, srcname)
+	}
+	sort.Strings(srcnames)
+	for _, srcname := range srcnames {
+		blocks := append([]Block(nil), p.Sources[srcname].Blocks...)
+		sort.Stable(blocksByStart(blocks))
+		for _, b := range blocks {
+			n, err := fmt.Fprintf(w, "%s:%d.%d,%d.%d %d %d\n",
+				srcname, b.StartLine, b.StartCol, b.EndLine, b.EndCol,
+				b.NumStmt, b.Count)
+			written += int64(n)
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/thediveo/gons/covmerge"
+)
+
+// goCoverDirEnv is the name of the environment variable Go 1.20+ test
+// binaries consult in order to find the directory where they (and any
+// process they in turn exec) should drop their binary coverage meta and
+// counter data files, see: https://go.dev/doc/build-cover.
+const goCoverDirEnv = "GOCOVERDIR"
+
+// InheritGOCOVERDIR returns env with the current process' GOCOVERDIR
+// environment variable added or overridden, so that a namespace-switched
+// re-execution writes its Go 1.20+ binary coverage meta and counter data
+// files into the very same directory as its parent test process. If
+// GOCOVERDIR isn't set in the current process' environment -- for instance,
+// because the parent test binary wasn't built with "-cover" -- then env is
+// returned unmodified and the re-executed child falls back to whatever
+// coverage instrumentation (if any) it was built with.
+func InheritGOCOVERDIR(env []string) []string {
+	dir, ok := os.LookupEnv(goCoverDirEnv)
+	if !ok {
+		return env
+	}
+	prefix := goCoverDirEnv + "="
+	for idx, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			env[idx] = prefix + dir
+			return env
+		}
+	}
+	return append(env, prefix+dir)
+}
+
+// mergeGocoverdir merges the Go 1.20+ binary coverage meta and counter data
+// found in the GOCOVERDIR directory dir into the summary coverage profile
+// sumcp.
+func mergeGocoverdir(dir string, sumcp *coverageProfile) error {
+	cp, err := readGocoverdirProfile(dir)
+	if err != nil {
+		return err
+	}
+	if cp == nil {
+		return nil
+	}
+	return sumcp.Merge(cp)
+}
+
+// readGocoverdirProfile reads the Go 1.20+ binary coverage meta and counter
+// data found in the GOCOVERDIR directory dir and returns it as a
+// covmerge.Profile, or nil if dir didn't contain any coverage data. Since the
+// meta and counter data files are in a binary format private to the Go
+// toolchain, we shell out to "go tool covdata textfmt" -- the officially
+// supported way of turning a GOCOVERDIR into a text-format coverage profile
+// -- and then parse the result using the very same pipeline used for
+// legacy, directly-produced text profiles.
+func readGocoverdirProfile(dir string) (*covmerge.Profile, error) {
+	tmp, err := os.CreateTemp("", "gons-covdata-*.out")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary coverage profile: %w", err)
+	}
+	tmpname := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpname)
+
+	cmd := exec.Command("go", "tool", "covdata", "textfmt",
+		"-i="+dir, "-o="+tmpname)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf(
+			"unable to convert GOCOVERDIR %q to text coverage profile: %w",
+			dir, err)
+	}
+	return readcovfile(tmpname), nil
+}
+
+// MergeCoverageProfile merges the coverage profile data found at path into
+// the summary coverage profile sumcp. The path may either name a legacy
+// text-mode coverage profile data file -- as produced by "go test
+// -coverprofile" on pre-1.20 toolchains, or by a re-executed child built
+// without coverage instrumentation support for GOCOVERDIR -- or a GOCOVERDIR
+// directory containing Go 1.20+ binary coverage meta and counter data files.
+// Which of the two formats to expect is detected automatically from what the
+// re-executed child actually produced, so callers don't need to know ahead
+// of time which toolchain version built a particular child.
+func MergeCoverageProfile(path string, sumcp *coverageProfile) {
+	fullpath := toOutputDir(path)
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Silently skip the situation when a re-execution did not create
+			// any coverage profile data at all.
+			return
+		}
+		panic(fmt.Sprintf(
+			"unable to merge coverage profile data %q: %s",
+			fullpath, err.Error()))
+	}
+	if fi.IsDir() {
+		if err := mergeGocoverdir(fullpath, sumcp); err != nil {
+			panic(err.Error())
+		}
+		return
+	}
+	mergeCoverageFile(path, sumcp)
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestInheritGOCOVERDIR(t *testing.T) {
+	prevDir, hadDir := os.LookupEnv(goCoverDirEnv)
+	defer func() {
+		if hadDir {
+			os.Setenv(goCoverDirEnv, prevDir)
+		} else {
+			os.Unsetenv(goCoverDirEnv)
+		}
+	}()
+
+	cases := []struct {
+		name string
+		dir  string // "" means GOCOVERDIR is unset in the current process.
+		env  []string
+		want []string
+	}{
+		{
+			name: "unset leaves env unchanged",
+			dir:  "",
+			env:  []string{"FOO=bar"},
+			want: []string{"FOO=bar"},
+		},
+		{
+			name: "set overrides an existing entry in place",
+			dir:  "/tmp/covdir",
+			env:  []string{"FOO=bar", "GOCOVERDIR=/old", "BAZ=quux"},
+			want: []string{"FOO=bar", "GOCOVERDIR=/tmp/covdir", "BAZ=quux"},
+		},
+		{
+			name: "set appends a missing entry",
+			dir:  "/tmp/covdir",
+			env:  []string{"FOO=bar"},
+			want: []string{"FOO=bar", "GOCOVERDIR=/tmp/covdir"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.dir == "" {
+				os.Unsetenv(goCoverDirEnv)
+			} else {
+				os.Setenv(goCoverDirEnv, c.dir)
+			}
+			env := append([]string(nil), c.env...)
+			got := InheritGOCOVERDIR(env)
+			if len(got) != len(c.want) {
+				t.Fatalf("InheritGOCOVERDIR(%v) = %v, want %v", c.env, got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Errorf("InheritGOCOVERDIR(%v) = %v, want %v", c.env, got, c.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+// TestReadGocoverdirProfileEmptyDir exercises the real "go tool covdata
+// textfmt" shell-out against an empty (but existing) GOCOVERDIR, the
+// simplest case that doesn't require a prebuilt "-cover" binary and its meta
+// and counter data files: covdata finds nothing to convert and writes an
+// empty text profile, which readcovfile (like a missing file) reports as a
+// nil profile rather than an error -- the same "no coverage data produced"
+// situation MergeCoverageProfile already relies on to silently skip.
+func TestReadGocoverdirProfileEmptyDir(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+	cp, err := readGocoverdirProfile(t.TempDir())
+	if err != nil {
+		t.Fatalf("readGocoverdirProfile: unexpected error: %s", err)
+	}
+	if cp != nil {
+		t.Errorf("readGocoverdirProfile: got %+v, want nil for an empty GOCOVERDIR", cp)
+	}
+}
+
+func TestReadGocoverdirProfileMissingDir(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+	if _, err := readGocoverdirProfile(t.TempDir() + "/does-not-exist"); err == nil {
+		t.Fatal("readGocoverdirProfile: expected an error for a non-existent GOCOVERDIR, got nil")
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Harald Albrecht.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testing
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/thediveo/gons/covmerge"
+)
+
+// MergeCoverageProfilePolicy merges the coverage profile data found at path
+// into the per-process summary profile sumpp, recording not just the
+// combined execution count for every block, but also how many distinct
+// re-executed processes contributed to it. This is what lets callers tell
+// apart a block that's hammered by one process from one that's only ever
+// reached by a namespace-switched child -- the distinction classic
+// count-only merging, as done by MergeCoverageProfile, throws away.
+//
+// Just like MergeCoverageProfile, path may name either a legacy text-mode
+// coverage profile data file or a GOCOVERDIR directory; which one is
+// detected automatically.
+func MergeCoverageProfilePolicy(path string, sumpp *covmerge.ProcessProfile) {
+	fullpath := toOutputDir(path)
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Silently skip the situation when a re-execution did not create
+			// any coverage profile data at all.
+			return
+		}
+		panic(fmt.Sprintf(
+			"unable to merge coverage profile data %q: %s",
+			fullpath, err.Error()))
+	}
+	var cp *covmerge.Profile
+	if fi.IsDir() {
+		cp, err = readGocoverdirProfile(fullpath)
+		if err != nil {
+			panic(err.Error())
+		}
+	} else {
+		cp = readcovfile(path)
+	}
+	if cp == nil {
+		return
+	}
+	if err := covmerge.MergeProcessProfile(sumpp, cp); err != nil {
+		panic(err.Error())
+	}
+}